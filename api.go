@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// --- REST API ---
+//
+// WebSocketを張らない簡易なコンシューマ（ダッシュボードやcronジョブ）向けに、
+// 現在の状態を読み取り専用で公開する。
+
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/ws", handleConnections)
+
+	r.HandleFunc("/api/state", requireScope("state:read", handleAPIState)).Methods(http.MethodGet)
+	r.HandleFunc("/api/state/{path:.*}", requireScope("state:read", handleAPIStatePath)).Methods(http.MethodGet)
+	r.HandleFunc("/api/channels", requireScope("channels:read", handleAPIChannels)).Methods(http.MethodGet)
+	r.HandleFunc("/api/users", requireScope("users:read", handleAPIUsers)).Methods(http.MethodGet)
+
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleAPIState(w http.ResponseWriter, r *http.Request) {
+	state, err := bus.State()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, state)
+}
+
+func handleAPIStatePath(w http.ResponseWriter, r *http.Request) {
+	path := "/" + mux.Vars(r)["path"]
+
+	state, err := bus.State()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	username, ok := state[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, map[string]string{"path": path, "username": username})
+}
+
+func handleAPIChannels(w http.ResponseWriter, r *http.Request) {
+	mapMutex.RLock()
+	defer mapMutex.RUnlock()
+
+	channels := make([]Channel, 0, len(channelMap))
+	for _, ch := range channelMap {
+		channels = append(channels, ch)
+	}
+	writeJSON(w, channels)
+}
+
+func handleAPIUsers(w http.ResponseWriter, r *http.Request) {
+	mapMutex.RLock()
+	defer mapMutex.RUnlock()
+	writeJSON(w, userMap)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// --- JWT認証 (任意) ---
+//
+// IQON_JWT_SECRETが設定されている場合のみ有効になる。未設定ならこれまで通り
+// 誰でも/wsに繋げて全REST APIを叩ける後方互換の挙動を維持する。
+// channelsクレームは購読できるパスを制限するのに使い、scopesクレームは
+// REST側のエンドポイントごとのアクセス制御に使う。
+
+// Claims はiQonが検証するJWTのペイロード（iQon自身はトークンを発行しない）
+type Claims struct {
+	Scopes   []string `json:"scopes"`
+	Channels []string `json:"channels"`
+	jwt.RegisteredClaims
+}
+
+// hasScope はclaimsがscope（または万能スコープ"*"）を持っているか判定する。
+// claimsがnil（認証無効時）なら常に許可する。
+func hasScope(claims *Claims, scope string) bool {
+	if claims == nil {
+		return true
+	}
+	for _, s := range claims.Scopes {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseToken はJWTを検証してClaimsを返す。IQON_JWT_SECRETが未設定なら
+// 認証は無効とみなし (nil, nil) を返す。
+func parseToken(tokenString string) (*Claims, error) {
+	if jwtSecret == "" {
+		return nil, nil
+	}
+	if tokenString == "" {
+		return nil, jwt.ErrTokenMalformed
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// wsToken はWebSocketアップグレードリクエストからトークンを取り出す。
+// ブラウザの拡張機能などSec-WebSocket-Protocolヘッダを使えないクライアント
+// 向けに?token=クエリパラメータもサポートする。
+func wsToken(r *http.Request) string {
+	if tok := r.URL.Query().Get("token"); tok != "" {
+		return tok
+	}
+	if proto := wsRequestedProtocol(r); proto != "" {
+		return proto
+	}
+	return ""
+}
+
+// wsRequestedProtocol はリクエストのSec-WebSocket-Protocolヘッダの最初の値を
+// 返す（無ければ空文字）。ブラウザのWebSocket APIはカスタムヘッダを送れない
+// ため、拡張機能はトークンをこのヘッダ経由で送ってくる。クライアントが提示した
+// サブプロトコルはハンドシェイク応答でも同じ値を返さないと、ブラウザ側が
+// ハンドシェイク失敗として接続を切ってしまう。
+func wsRequestedProtocol(r *http.Request) string {
+	proto := r.Header.Get("Sec-WebSocket-Protocol")
+	if proto == "" {
+		return ""
+	}
+	return strings.TrimSpace(strings.Split(proto, ",")[0])
+}
+
+// authenticateWS はIQON_JWT_SECRETが設定されている場合にのみ/wsへの
+// アップグレードリクエストを検証する。未設定なら常に(nil, nil)。
+func authenticateWS(r *http.Request) (*Claims, error) {
+	if jwtSecret == "" {
+		return nil, nil
+	}
+	return parseToken(wsToken(r))
+}
+
+// restToken はAuthorization: Bearer <token> ヘッダからトークンを取り出す
+func restToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, prefix)
+}
+
+// requireScope はIQON_JWT_SECRETが設定されている場合のみ、リクエストのJWTが
+// scopeを持っていることを要求するハンドララッパー。未設定なら素通しする。
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if jwtSecret == "" {
+			next(w, r)
+			return
+		}
+
+		claims, err := parseToken(restToken(r))
+		if err != nil || !hasScope(claims, scope) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Bus: ブロードキャスト層の抽象化 ---
+//
+// 単一プロセスで動く分にはインメモリのMemoryBusで十分だが、ロードバランサ配下に
+// 複数インスタンスを並べる（HA構成）場合は、どのインスタンスが受けたUPDATEも
+// 全インスタンスのローカルWebSocketクライアントへ届ける必要がある。
+// RedisBusはPUBLISH/SUBSCRIBEでそれを行い、lastSpeakersの正本はRedis hashに置く。
+
+// Bus はExtensionUpdateの配信と、現在の発言者状態の共有を担う
+type Bus interface {
+	// Publish は更新を記録・配信する。Subscribeで登録したhandlerは
+	// (自分自身がpublishした分も含め) 最終的に呼び出される。
+	Publish(update ExtensionUpdate) error
+
+	// Subscribe はUPDATEを受け取るhandlerを登録する。ローカルWebSocket
+	// クライアントへの配信はこのhandlerの中で行う想定。
+	Subscribe(handler func(ExtensionUpdate)) error
+
+	// State は現在の（正本の）lastSpeakersを返す
+	State() (map[string]string, error)
+
+	Close() error
+}
+
+// --- インメモリ実装 (単一インスタンスのデフォルト) ---
+
+type MemoryBus struct {
+	mu      sync.Mutex
+	handler func(ExtensionUpdate)
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Publish(update ExtensionUpdate) error {
+	stateMutex.Lock()
+	lastSpeakers[update.ChannelPath] = update.Username
+	stateMutex.Unlock()
+
+	b.mu.Lock()
+	handler := b.handler
+	b.mu.Unlock()
+
+	if handler != nil {
+		handler(update)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(handler func(ExtensionUpdate)) error {
+	b.mu.Lock()
+	b.handler = handler
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *MemoryBus) State() (map[string]string, error) {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+
+	out := make(map[string]string, len(lastSpeakers))
+	for path, username := range lastSpeakers {
+		out[path] = username
+	}
+	return out, nil
+}
+
+func (b *MemoryBus) Close() error { return nil }
+
+// --- Redis実装 (複数インスタンスでのHA構成用) ---
+
+const (
+	updatesChannel  = "iqon:updates"
+	pollerLockKey   = "iqon:poller-lock"
+	speakersHashKey = "iqon:speakers"
+
+	leaseTTL        = 10 * time.Second
+	leaseRenewEvery = 3 * time.Second
+	leaseRetryEvery = 2 * time.Second
+)
+
+// renewLeaseScript はロックを今も自分が保持している場合に限り有効期限を延長する
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+	return 0
+end
+`)
+
+// RedisBus はPUBLISH/SUBSCRIBEで複数インスタンス間にUPDATEを配り、
+// lastSpeakersの正本をRedis hashに持つBus実装
+type RedisBus struct {
+	client     *redis.Client
+	instanceID string
+}
+
+func NewRedisBus(addr, instanceID string) *RedisBus {
+	return &RedisBus{
+		client:     redis.NewClient(&redis.Options{Addr: addr}),
+		instanceID: instanceID,
+	}
+}
+
+func (b *RedisBus) Publish(update ExtensionUpdate) error {
+	ctx := context.Background()
+
+	if err := b.client.HSet(ctx, speakersHashKey, update.ChannelPath, update.Username).Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, updatesChannel, data).Err()
+}
+
+func (b *RedisBus) Subscribe(handler func(ExtensionUpdate)) error {
+	sub := b.client.Subscribe(context.Background(), updatesChannel)
+
+	go func() {
+		for msg := range sub.Channel() {
+			var update ExtensionUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+				log.Printf("⚠️ Bad update payload from bus: %v", err)
+				continue
+			}
+
+			stateMutex.Lock()
+			lastSpeakers[update.ChannelPath] = update.Username
+			stateMutex.Unlock()
+
+			handler(update)
+		}
+	}()
+
+	return nil
+}
+
+func (b *RedisBus) State() (map[string]string, error) {
+	return b.client.HGetAll(context.Background(), speakersHashKey).Result()
+}
+
+func (b *RedisBus) Close() error {
+	return b.client.Close()
+}
+
+// runAsLeader はRedisの "SET NX PX" リースを使ったリーダー選出で
+// pollerLockKeyを獲得するまでブロックし（ctxがキャンセルされれば諦める）、
+// 獲得したらリースを更新し続けながらfn(ctx)を実行する。
+// 複数インスタンスのうち1台だけがfn（ポーリング）を実行する。
+// リースを失った場合はfnに渡したcontextをcancelしてfnを止め、（全体のctxが
+// まだ生きていれば）リーダー選出からやり直す。
+func (b *RedisBus) runAsLeader(ctx context.Context, fn func(context.Context)) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		ok, err := b.client.SetNX(ctx, pollerLockKey, b.instanceID, leaseTTL).Result()
+		if err != nil {
+			log.Printf("⚠️ Leader election error: %v", err)
+		}
+		if err == nil && ok {
+			log.Printf("👑 Elected as poller leader (instance %s)", b.instanceID)
+
+			leaderCtx, cancelLeader := context.WithCancel(ctx)
+			stop := make(chan struct{})
+			go b.renewLease(stop, cancelLeader)
+			fn(leaderCtx)
+			close(stop)
+			cancelLeader()
+
+			if ctx.Err() != nil {
+				return
+			}
+			// リース喪失などでリーダーでなくなった場合は選出からやり直す
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseRetryEvery):
+		}
+	}
+}
+
+// renewLease はリースを保持し続けている間だけ更新を続ける。更新に失敗した、
+// または他インスタンスにリースを奪われたと分かった時点でcancelLeaderを呼び、
+// fn(leaderCtx)（ポーリング）を止めさせる。
+func (b *RedisBus) renewLease(stop chan struct{}, cancelLeader context.CancelFunc) {
+	ticker := time.NewTicker(leaseRenewEvery)
+	defer ticker.Stop()
+	ctx := context.Background()
+
+	for {
+		select {
+		case <-ticker.C:
+			res, err := renewLeaseScript.Run(ctx, b.client, []string{pollerLockKey}, b.instanceID, leaseTTL.Milliseconds()).Int()
+			if err != nil {
+				log.Printf("⚠️ Failed to renew poller lease: %v", err)
+				cancelLeader()
+				return
+			}
+			if res == 0 {
+				log.Println("⚠️ Lost poller lease to another instance")
+				cancelLeader()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
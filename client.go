@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- WebSocketクライアント管理 ---
+//
+// 各クライアントは送信用のバッファ付きチャンネルと専用のwriterゴルーチンを持つ。
+// これにより、遅い（または半死の）クライアント1台がbroadcastToClients全体を
+// ブロックすることがなくなる。
+
+const (
+	// クライアントごとの送信キューの深さ
+	clientSendBuffer = 64
+
+	// 書き込み1回あたりの猶予
+	writeWait = 10 * time.Second
+
+	// pongを待つ時間。この間にpongが来なければ死んでいるとみなす
+	pongWait = 60 * time.Second
+
+	// pingを送る間隔。pongWaitより十分短くする
+	pingPeriod = (pongWait * 9) / 10
+)
+
+// Client は1つのWebSocket接続をラップし、送信をシリアライズする
+type Client struct {
+	conn *websocket.Conn
+	send chan interface{}
+
+	// subs はこのクライアントが購読しているパスパターン。空なら全パス購読扱い
+	subs   []string
+	subsMu sync.RWMutex
+
+	// allowed はJWTのchannelsクレームに由来する購読可能パターン。
+	// 空（認証無効時、またはクレーム未指定時）なら制限なし
+	allowed []string
+}
+
+var (
+	clients   = make(map[*Client]bool)
+	clientsMu sync.Mutex
+)
+
+func registerClient(c *Client) {
+	clientsMu.Lock()
+	clients[c] = true
+	clientsMu.Unlock()
+}
+
+// unregisterClient はクライアントをマップから外し、送信チャンネルを閉じる。
+// 二重closeを避けるため、マップに存在する場合のみ閉じる。
+func unregisterClient(c *Client) {
+	clientsMu.Lock()
+	if _, ok := clients[c]; ok {
+		delete(clients, c)
+		close(c.send)
+	}
+	clientsMu.Unlock()
+}
+
+// broadcastToClients は購読中のクライアントへノンブロッキングで配信する。
+// 送信キューが詰まっているクライアントはdropして切断する（バックプレッシャー）。
+func broadcastToClients(update ExtensionUpdate) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for c := range clients {
+		if !c.wants(update.ChannelPath) {
+			continue
+		}
+		enqueueLocked(c, update)
+	}
+}
+
+// enqueueLocked はc.sendへノンブロッキングで書き込み、詰まっていればdropして
+// クローズする。c.sendへの書き込み・close（こことunregisterClient）は必ず
+// clientsMuの下で行い、呼び出し元はclientsMuを保持していなければならない。こうしないと、
+// 別ゴルーチンがclose(c.send)した直後に送信してパニックする恐れがある。
+func enqueueLocked(c *Client, data interface{}) {
+	select {
+	case c.send <- data:
+	default:
+		log.Println("⚠️ Client send queue full, dropping client")
+		delete(clients, c)
+		close(c.send)
+		c.conn.Close()
+	}
+}
+
+// sendToClient はclientsMuを取った上でenqueueLockedを呼ぶ。すでにunregister済み
+// (closeされ、clientsから消えている)クライアントへは何もしない。
+func sendToClient(c *Client, data interface{}) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if _, ok := clients[c]; !ok {
+		return
+	}
+	enqueueLocked(c, data)
+}
+
+// writePump はsendチャンネルから読み出してWriteJSONし、合わせてkeepalive用の
+// pingをtickerで送る。sendチャンネルがcloseされたら終了する。
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump はクライアントからのメッセージ（pong含む）を読み続け、read deadlineを
+// 更新し続ける。接続が切れたらreturnし、それによって呼び出し元に切断を伝える。
+func (c *Client) readPump() {
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		c.handleMessage(data)
+	}
+}
+
+// handleMessage はクライアントから届いた制御メッセージを処理する。
+// 現状対応しているのはSUBSCRIBEのみで、他は無視する。
+func (c *Client) handleMessage(data []byte) {
+	var msg SubscribeMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	if msg.Type != "SUBSCRIBE" {
+		return
+	}
+
+	c.setSubscriptions(msg.Paths)
+
+	sendToClient(c, ExtensionInit{
+		Type:  "INIT",
+		State: c.snapshotFor(),
+	})
+}
+
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	claims, err := authenticateWS(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// クライアントがSec-WebSocket-Protocolでトークンを送ってきた場合は、
+	// ハンドシェイク応答で同じ値を返す。これがないとブラウザはハンドシェイクを
+	// 失敗として扱い、接続を確立できない。
+	var respHeader http.Header
+	if proto := wsRequestedProtocol(r); proto != "" {
+		respHeader = http.Header{"Sec-WebSocket-Protocol": {proto}}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	shutdownWG.Add(1)
+	defer shutdownWG.Done()
+
+	c := &Client{
+		conn: ws,
+		send: make(chan interface{}, clientSendBuffer),
+	}
+	if claims != nil {
+		c.allowed = claims.Channels
+	}
+	registerClient(c)
+
+	sendToClient(c, ExtensionInit{
+		Type:  "INIT",
+		State: c.snapshotFor(),
+	})
+
+	go c.writePump()
+
+	// readPumpはこのゴルーチンでブロックし、接続が切れたら後片付けする
+	c.readPump()
+	unregisterClient(c)
+}
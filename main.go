@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -54,6 +57,9 @@ type ExtensionInit struct {
 var (
 	botToken string
 
+	// jwtSecret が空ならWS/REST双方とも認証なしの今まで通りの挙動になる
+	jwtSecret string
+
 	// データキャッシュ (名簿)
 	channelMap = make(map[string]Channel)
 	userMap    = make(map[string]string)
@@ -63,11 +69,12 @@ var (
 	lastSpeakers = make(map[string]string)
 	stateMutex   sync.RWMutex
 
-	clients   = make(map[*websocket.Conn]bool)
-	clientsMu sync.Mutex
-
 	lastCheckTime time.Time
 
+	// bus はブロードキャストの配信経路。デフォルトはプロセス内のみで完結する
+	// MemoryBusで、REDIS_ADDRが設定されていれば複数インスタンス対応のRedisBusになる
+	bus Bus = NewMemoryBus()
+
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
@@ -79,69 +86,159 @@ func main() {
 		log.Fatal("ERROR: TRAQ_BOT_TOKEN is not set")
 	}
 
-	log.Println("⏳ Fetching initial data...")
-	if err := fetchInitialData(); err != nil {
-		log.Fatalf("Failed to fetch initial data: %v", err)
+	jwtSecret = os.Getenv("IQON_JWT_SECRET")
+	if jwtSecret == "" {
+		log.Println("⚠️ IQON_JWT_SECRET not set, running with open access (no auth)")
+	}
+
+	dbPath := os.Getenv("IQON_DB_PATH")
+	if dbPath == "" {
+		dbPath = "iqon.db"
+	}
+	store, err := NewBoltStore(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+
+	snap, err := store.Load()
+	if err != nil {
+		log.Fatalf("Failed to load persisted state: %v", err)
 	}
 
-	lastCheckTime = time.Now().UTC()
+	if snap != nil && len(snap.Channels) > 0 && len(snap.Users) > 0 {
+		log.Printf("💾 Restored %d channels, %d users from disk", len(snap.Channels), len(snap.Users))
+		restoreCaches(*snap)
+	} else {
+		log.Println("⏳ Fetching initial data...")
+		if err := fetchInitialData(); err != nil {
+			log.Fatalf("Failed to fetch initial data: %v", err)
+		}
+	}
 
-	// ポーリング開始
-	go startPolling()
+	// lastSpeakers/カーソルの復元は、channelMap/userMapが復元できたか（snapが
+	// fetchInitialData前のものでなかったか）とは無関係に行う。そうしないと、
+	// channels/usersが空のスナップショット（fetchInitialData前に保存された等）の
+	// 場合にfetchInitialData()へ倒れつつ、下のカーソル再開ロジックだけは
+	// snap.LastCheckTimeを信用してしまい、学習済みのlastSpeakersを失ったまま
+	// ダウンタイム中の再生ウィンドウもスキップすることになる。
+	if snap != nil {
+		restoreSpeakers(*snap)
+	}
 
-	// サーバー起動
-	http.HandleFunc("/ws", handleConnections)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	// 永続化されたカーソルがあればそこから再開する（ダウンタイム中の活動を取りこぼさないため）。
+	// ただし長時間停止していた場合の巨大なバックフィルは避け、最大1時間分に留める。
+	// lastCheckTimeはpersistLoop (snapshotCaches) からstateMutex越しに読まれるので、
+	// ここでの代入もstateMutexの下で行う。
+	cutoff := time.Now().UTC().Add(-maxCatchUp)
+	stateMutex.Lock()
+	if snap != nil && !snap.LastCheckTime.IsZero() && snap.LastCheckTime.After(cutoff) {
+		lastCheckTime = snap.LastCheckTime
+		log.Printf("⏪ Resuming from persisted cursor: %s", lastCheckTime)
+	} else {
+		if snap != nil && !snap.LastCheckTime.IsZero() {
+			lastCheckTime = cutoff
+			log.Printf("⏪ Persisted cursor too old, catching up from %s", lastCheckTime)
+		} else {
+			lastCheckTime = time.Now().UTC()
+		}
+	}
+	stateMutex.Unlock()
+
+	// SIGTERM/SIGINT (コンテナオーケストレータからの停止要求など) で
+	// キャンセルされるルートcontext。ポーリングと永続化ループはこれを見て止まる。
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownWG.Add(1)
+	go func() {
+		defer shutdownWG.Done()
+		persistLoop(ctx, store, persistInterval)
+	}()
+
+	// REDIS_ADDRがあれば複数インスタンスでのHA構成とみなし、RedisBusに切り替える。
+	// この場合、ポーリングはリーダーに選出されたインスタンスだけが行う。
+	shutdownWG.Add(1)
+	if redisAddr := os.Getenv("REDIS_ADDR"); redisAddr != "" {
+		hostname, _ := os.Hostname()
+		instanceID := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		redisBus := NewRedisBus(redisAddr, instanceID)
+		bus = redisBus
+
+		go func() {
+			defer shutdownWG.Done()
+			redisBus.runAsLeader(ctx, startPolling)
+		}()
+	} else {
+		go func() {
+			defer shutdownWG.Done()
+			startPolling(ctx)
+		}()
+	}
 
+	if err := bus.Subscribe(broadcastToClients); err != nil {
+		log.Fatalf("Failed to subscribe to bus: %v", err)
+	}
+
+	// サーバー起動
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("🚀 Server started on :%s (Auto-Learning Mode)", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: newRouter(),
 	}
+
+	log.Printf("🚀 Server started on :%s (Auto-Learning Mode)", port)
+	runServer(ctx, srv, store)
 }
 
 // --- ポーリング処理 ---
 
-func startPolling() {
+func startPolling(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	client := &http.Client{Timeout: 5 * time.Second}
 	log.Println("👀 Polling started...")
 
-	for range ticker.C {
-		// 全パブリックチャンネルのアクテビティを取得
-		url := "https://q.trap.jp/api/v3/activity/timeline?all=true&limit=50"
-		req, _ := http.NewRequest("GET", url, nil)
-		req.Header.Set("Authorization", "Bearer "+botToken)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("👀 Polling stopped")
+			return
+		case <-ticker.C:
+			// 全パブリックチャンネルのアクテビティを取得
+			url := "https://q.trap.jp/api/v3/activity/timeline?all=true&limit=50"
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				log.Printf("Polling error: %v", err)
+				continue
+			}
+			req.Header.Set("Authorization", "Bearer "+botToken)
 
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Polling error: %v", err)
-			continue
-		}
-		
-		if resp.StatusCode != 200 {
-			log.Printf("Polling failed: Status %d", resp.StatusCode)
-			resp.Body.Close()
-			continue
-		}
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Polling error: %v", err)
+				continue
+			}
+
+			if resp.StatusCode != 200 {
+				log.Printf("Polling failed: Status %d", resp.StatusCode)
+				resp.Body.Close()
+				continue
+			}
 
-		var timeline []ActivityMessage
-		if err := json.NewDecoder(resp.Body).Decode(&timeline); err != nil {
-			log.Printf("JSON decode error: %v", err)
+			var timeline []ActivityMessage
+			if err := json.NewDecoder(resp.Body).Decode(&timeline); err != nil {
+				log.Printf("JSON decode error: %v", err)
+				resp.Body.Close()
+				continue
+			}
 			resp.Body.Close()
-			continue
-		}
-		resp.Body.Close()
 
-		processTimeline(timeline)
+			processTimeline(timeline)
+		}
 	}
 }
 
@@ -150,7 +247,14 @@ func processTimeline(messages []ActivityMessage) {
 		return
 	}
 
-	newestInBatch := lastCheckTime
+	// lastCheckTimeはpersistLoop (snapshotCaches) からstateMutex越しに読まれるので、
+	// ここでも読み書きをstateMutexで保護する。ループ中は一貫したローカルの値
+	// (cursor)で比較し、最後にまとめて書き戻す。
+	stateMutex.RLock()
+	cursor := lastCheckTime
+	stateMutex.RUnlock()
+
+	newestInBatch := cursor
 	updates := make(map[string]ExtensionUpdate)
 
 	// APIは新しい順に来るので、逆順（古い順）に処理
@@ -158,7 +262,7 @@ func processTimeline(messages []ActivityMessage) {
 		msg := messages[i]
 
 		// すでに処理済みの時刻以前ならスキップ
-		if !msg.CreatedAt.After(lastCheckTime) {
+		if !msg.CreatedAt.After(cursor) {
 			continue
 		}
 		// 最新時刻の更新
@@ -181,153 +285,18 @@ func processTimeline(messages []ActivityMessage) {
 		}
 	}
 
+	stateMutex.Lock()
 	lastCheckTime = newestInBatch
+	stateMutex.Unlock()
 
-	if len(updates) > 0 {
-		stateMutex.Lock()
-		for path, update := range updates {
-			lastSpeakers[path] = update.Username
-			log.Printf("📢 Update: %s -> @%s", path, update.Username)
-			broadcastToClients(update)
+	for path, update := range updates {
+		log.Printf("📢 Update: %s -> @%s", path, update.Username)
+		if err := bus.Publish(update); err != nil {
+			log.Printf("⚠️ Failed to publish update: %v", err)
 		}
-		stateMutex.Unlock()
 	}
 }
 
-// --- 学習機能付き解決ロジック ---
-
-// resolveUser: キャッシュになければAPIから取得して登録する
-func resolveUser(userID string) string {
-	// 1. キャッシュチェック (Read Lock)
-	mapMutex.RLock()
-	name, ok := userMap[userID]
-	mapMutex.RUnlock()
-	if ok {
-		return name
-	}
-
-	// 2. キャッシュになければAPIへ問い合わせ
-	// (ロックを外してから通信する)
-	log.Printf("🔍 Unknown UserID: %s. Fetching...", userID)
-	
-	newUser, err := fetchSingleUser(userID)
-	
-	// 3. 結果を登録 (Write Lock)
-	mapMutex.Lock()
-	defer mapMutex.Unlock()
-
-	// 通信中に別のゴルーチンが書き込んだかもしれないので再チェック
-	if name, exists := userMap[userID]; exists {
-		return name
-	}
-
-	if err != nil {
-		log.Printf("⚠️ User fetch failed (%v). Treating as webhook.", err)
-		// 取得に失敗したら "webhook" として登録し、次回以降のエラーを防ぐ
-		userMap[userID] = "webhook"
-		return "webhook"
-	}
-
-	userMap[userID] = newUser.Name
-	log.Printf("✅ Learned User: %s -> @%s", userID, newUser.Name)
-	return newUser.Name
-}
-
-// resolveChannelPath: 親も含めてパスを解決。知らなければ取得して登録する
-func resolveChannelPath(channelID string) string {
-	// パス構築用の一時キャッシュとして使うマップのコピーを持つのは非効率なので、
-	// 毎回親をたどる方式にする。足りない親がいればその都度fetchする。
-
-	path := ""
-	currentID := channelID
-
-	for {
-		// 1. キャッシュチェック
-		mapMutex.RLock()
-		ch, ok := channelMap[currentID]
-		mapMutex.RUnlock()
-
-		// 2. 知らないチャンネルならAPIから取得
-		if !ok {
-			log.Printf("🔍 Unknown ChannelID: %s. Fetching...", currentID)
-			fetchedCh, err := fetchSingleChannel(currentID)
-			
-			mapMutex.Lock()
-			if err != nil {
-				mapMutex.Unlock()
-				log.Printf("❌ Failed to fetch channel %s: %v", currentID, err)
-				return "" // 解決不能
-			}
-			// 登録
-			channelMap[currentID] = *fetchedCh
-			ch = *fetchedCh
-			mapMutex.Unlock()
-			log.Printf("✅ Learned Channel: %s", ch.Name)
-		}
-
-		// パスを積み上げ
-		path = "/" + ch.Name + path
-
-		// ルートまで来たら終了
-		if ch.ParentID == "" || ch.ParentID == "00000000-0000-0000-0000-000000000000" {
-			break
-		}
-		currentID = ch.ParentID
-	}
-
-	return "/channels" + path
-}
-
-// --- 単発取得用APIクライアント ---
-
-func fetchSingleUser(userID string) (*User, error) {
-	client := &http.Client{Timeout: 5 * time.Second}
-	url := fmt.Sprintf("https://q.trap.jp/api/v3/users/%s", userID)
-	
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+botToken)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status %d", resp.StatusCode)
-	}
-
-	var u User
-	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
-		return nil, err
-	}
-	return &u, nil
-}
-
-func fetchSingleChannel(channelID string) (*Channel, error) {
-	client := &http.Client{Timeout: 5 * time.Second}
-	url := fmt.Sprintf("https://q.trap.jp/api/v3/channels/%s", channelID)
-
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+botToken)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status %d", resp.StatusCode)
-	}
-
-	var ch Channel
-	if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
-		return nil, err
-	}
-	return &ch, nil
-}
-
 // --- 初期データ一括取得 (起動時用) ---
 
 func fetchInitialData() error {
@@ -375,43 +344,3 @@ func fetchInitialData() error {
 	return nil
 }
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer ws.Close()
-
-	clientsMu.Lock()
-	clients[ws] = true
-	clientsMu.Unlock()
-
-	stateMutex.RLock()
-	initMsg := ExtensionInit{
-		Type:  "INIT",
-		State: lastSpeakers,
-	}
-	stateMutex.RUnlock()
-	ws.WriteJSON(initMsg)
-
-	for {
-		if _, _, err := ws.ReadMessage(); err != nil {
-			clientsMu.Lock()
-			delete(clients, ws)
-			clientsMu.Unlock()
-			break
-		}
-	}
-}
-
-func broadcastToClients(data interface{}) {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
-	for client := range clients {
-		if err := client.WriteJSON(data); err != nil {
-			client.Close()
-			delete(clients, client)
-		}
-	}
-}
\ No newline at end of file
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+)
+
+// --- 学習機能付き解決ロジック ---
+//
+// resolveUser/resolveChannelPathはキャッシュミス時にtraQへ単発取得をかける。
+// バーストした未知IDが同時に来た場合でも、singleflightで同一ID宛のリクエストを
+// 1本に束ね、さらにsemaphoreで同時実行数に上限を設けてtraQ側への負荷を抑える。
+
+const (
+	// 同時に飛ばせる単発fetchの上限
+	maxConcurrentFetches = 16
+
+	// 取得失敗したユーザーIDを"webhook"扱いのまま保持する期間。
+	// これを過ぎたら再度本物のfetchを試みる。
+	negativeCacheTTL = 5 * time.Minute
+)
+
+var (
+	userSF    singleflight.Group
+	channelSF singleflight.Group
+
+	fetchSem = semaphore.NewWeighted(maxConcurrentFetches)
+
+	negativeMu    sync.Mutex
+	negativeUsers = make(map[string]time.Time)
+)
+
+// resolveUser: キャッシュになければAPIから取得して登録する
+func resolveUser(userID string) string {
+	// 1. キャッシュチェック (Read Lock)
+	mapMutex.RLock()
+	name, ok := userMap[userID]
+	mapMutex.RUnlock()
+	if ok && !isNegativeExpired(userID) {
+		return name
+	}
+
+	// 2. キャッシュになければAPIへ問い合わせ。同一IDの同時呼び出しは1本に束ねる。
+	log.Printf("🔍 Unknown UserID: %s. Fetching...", userID)
+
+	v, err, _ := userSF.Do(userID, func() (interface{}, error) {
+		if err := fetchSem.Acquire(context.Background(), 1); err != nil {
+			return nil, err
+		}
+		defer fetchSem.Release(1)
+		return fetchSingleUser(userID)
+	})
+
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+
+	if err != nil {
+		log.Printf("⚠️ User fetch failed (%v). Treating as webhook.", err)
+		userMap[userID] = "webhook"
+		markNegative(userID)
+		return "webhook"
+	}
+
+	newUser := v.(*User)
+	userMap[userID] = newUser.Name
+	clearNegative(userID)
+	log.Printf("✅ Learned User: %s -> @%s", userID, newUser.Name)
+	return newUser.Name
+}
+
+// markNegative はuserIDを取得失敗としてnegativeCacheTTLの間記録する
+func markNegative(userID string) {
+	negativeMu.Lock()
+	negativeUsers[userID] = time.Now()
+	negativeMu.Unlock()
+}
+
+func clearNegative(userID string) {
+	negativeMu.Lock()
+	delete(negativeUsers, userID)
+	negativeMu.Unlock()
+}
+
+// isNegativeExpired はuserIDが取得失敗として記録されていて、かつTTLを過ぎている場合true。
+// TTLを過ぎていれば再fetchさせるため、キャッシュヒットを無視させる。
+func isNegativeExpired(userID string) bool {
+	negativeMu.Lock()
+	markedAt, ok := negativeUsers[userID]
+	negativeMu.Unlock()
+	if !ok {
+		return false
+	}
+	return time.Since(markedAt) > negativeCacheTTL
+}
+
+// resolveChannelPath: 親も含めてパスを解決。知らなければ取得して登録する
+func resolveChannelPath(channelID string) string {
+	// パス構築用の一時キャッシュとして使うマップのコピーを持つのは非効率なので、
+	// 毎回親をたどる方式にする。足りない親がいればその都度fetchする。
+
+	path := ""
+	currentID := channelID
+
+	for {
+		// 1. キャッシュチェック
+		mapMutex.RLock()
+		ch, ok := channelMap[currentID]
+		mapMutex.RUnlock()
+
+		// 2. 知らないチャンネルならAPIから取得。同一IDの同時呼び出しは1本に束ねる。
+		if !ok {
+			log.Printf("🔍 Unknown ChannelID: %s. Fetching...", currentID)
+
+			id := currentID
+			v, err, _ := channelSF.Do(id, func() (interface{}, error) {
+				if err := fetchSem.Acquire(context.Background(), 1); err != nil {
+					return nil, err
+				}
+				defer fetchSem.Release(1)
+				return fetchSingleChannel(id)
+			})
+			if err != nil {
+				log.Printf("❌ Failed to fetch channel %s: %v", currentID, err)
+				return "" // 解決不能
+			}
+
+			fetchedCh := v.(*Channel)
+			mapMutex.Lock()
+			channelMap[currentID] = *fetchedCh
+			mapMutex.Unlock()
+			ch = *fetchedCh
+			log.Printf("✅ Learned Channel: %s", ch.Name)
+		}
+
+		// パスを積み上げ
+		path = "/" + ch.Name + path
+
+		// ルートまで来たら終了
+		if ch.ParentID == "" || ch.ParentID == "00000000-0000-0000-0000-000000000000" {
+			break
+		}
+		currentID = ch.ParentID
+	}
+
+	return "/channels" + path
+}
+
+// --- 単発取得用APIクライアント ---
+
+func fetchSingleUser(userID string) (*User, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	url := fmt.Sprintf("https://q.trap.jp/api/v3/users/%s", userID)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+botToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var u User
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func fetchSingleChannel(channelID string) (*Channel, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	url := fmt.Sprintf("https://q.trap.jp/api/v3/channels/%s", channelID)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+botToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var ch Channel
+	if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- グレースフルシャットダウン ---
+//
+// SIGTERM/SIGINTを受けたら、新規接続の受付を止めつつ既存のWebSocketクライアントに
+// BYEを送り、ポーリング・永続化の各ゴルーチンにcontext経由で停止を伝え、状態を
+// flushしてから、それらのゴルーチンと接続のドレインを待ってプロセスを終了する。
+
+// shutdownGrace はShutdown開始からの猶予時間
+const shutdownGrace = 15 * time.Second
+
+// shutdownWG はシャットダウン時にドレインを待つべきゴルーチン
+// (ポーリング、永続化ループ、各WebSocket接続)を数える
+var shutdownWG sync.WaitGroup
+
+// runServer はsrvを起動し、ctxがキャンセルされるまでブロックする。
+// キャンセルされたら既存クライアントへBYEを送り、srv.Shutdownで新規受付を止め、
+// storeへ最後のスナップショットをflushし、全ゴルーチンのドレインを待つ。
+func runServer(ctx context.Context, srv *http.Server, store Store) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server error: %v", err)
+		}
+	case <-ctx.Done():
+		log.Println("🛑 Shutdown signal received, draining...")
+
+		broadcastBye()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("⚠️ Server shutdown error: %v", err)
+		}
+	}
+
+	if err := store.Save(snapshotCaches()); err != nil {
+		log.Printf("⚠️ Failed to flush persistence on shutdown: %v", err)
+	}
+
+	drain()
+
+	if err := store.Close(); err != nil {
+		log.Printf("⚠️ Failed to close store: %v", err)
+	}
+	if err := bus.Close(); err != nil {
+		log.Printf("⚠️ Failed to close bus: %v", err)
+	}
+
+	log.Println("👋 Shutdown complete")
+}
+
+// drain はshutdownWGが空になるのをまずshutdownGraceまで待つ。
+// BYEはアプリレベルのJSONメッセージに過ぎず、受け取った拡張機能がそれで
+// 切断してくれる保証はない。猶予時間内にドレインしきれなければ、残っている
+// 接続を強制的にcloseしてreadPumpを解放し、その後あらためてshutdownWGが空に
+// なるまで（期限なしで）待つ。
+func drain() {
+	done := make(chan struct{})
+	go func() {
+		shutdownWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(shutdownGrace):
+		log.Println("⚠️ Shutdown grace period elapsed, force-closing remaining clients")
+		forceCloseClients()
+	}
+
+	<-done
+}
+
+// forceCloseClients は残っている全クライアント接続をcloseする。これにより
+// readPumpのReadMessageがエラーを返して抜け、handleConnectionsが
+// unregisterClientを呼んで戻る際にshutdownWGがDoneされる。
+func forceCloseClients() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for c := range clients {
+		c.conn.Close()
+	}
+}
+
+// broadcastBye はクローズ中であることを全クライアントへ知らせる
+func broadcastBye() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for c := range clients {
+		enqueueLocked(c, map[string]string{"type": "BYE"})
+	}
+}
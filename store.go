@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// --- 永続化 ---
+//
+// channelMap/userMap/lastSpeakers/lastCheckTimeは再起動のたびに失われていた。
+// Storeはそれらのスナップショットを定期的に（および正常終了時に）保存し、
+// 起動時に復元することでfetchInitialDataの burst と INIT の空打ちを避ける。
+
+// Snapshot は永続化対象のキャッシュ一式
+type Snapshot struct {
+	Channels      map[string]Channel `json:"channels"`
+	Users         map[string]string  `json:"users"`
+	LastSpeakers  map[string]string  `json:"lastSpeakers"`
+	LastCheckTime time.Time          `json:"lastCheckTime"`
+}
+
+// Store はキャッシュと処理済みカーソルの永続化を担う
+type Store interface {
+	Load() (*Snapshot, error)
+	Save(snap Snapshot) error
+	Close() error
+}
+
+const (
+	// persistInterval はスナップショットをディスクに保存する間隔
+	persistInterval = 30 * time.Second
+
+	// maxCatchUp は永続化されたカーソルから再開する際に遡る最大期間
+	maxCatchUp = 1 * time.Hour
+)
+
+var (
+	snapshotBucket = []byte("iqon")
+	snapshotKey    = []byte("snapshot")
+)
+
+// BoltStore はBoltDB (go.etcd.io/bbolt) を使ったデフォルトのStore実装
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore はpathにあるBoltDBファイルを開く（なければ作成する）
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(snapshotBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Load は最後に保存されたスナップショットを返す。保存済みデータがなければ
+// (nil, nil) を返す。
+func (s *BoltStore) Load() (*Snapshot, error) {
+	var snap *Snapshot
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(snapshotBucket).Get(snapshotKey)
+		if data == nil {
+			return nil
+		}
+		var loaded Snapshot
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return err
+		}
+		snap = &loaded
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *BoltStore) Save(snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(snapshotBucket).Put(snapshotKey, data)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// snapshotCaches は現在のキャッシュ一式のコピーを作る
+func snapshotCaches() Snapshot {
+	mapMutex.RLock()
+	channels := make(map[string]Channel, len(channelMap))
+	for id, ch := range channelMap {
+		channels[id] = ch
+	}
+	users := make(map[string]string, len(userMap))
+	for id, name := range userMap {
+		users[id] = name
+	}
+	mapMutex.RUnlock()
+
+	stateMutex.RLock()
+	speakers := make(map[string]string, len(lastSpeakers))
+	for path, name := range lastSpeakers {
+		speakers[path] = name
+	}
+	cursor := lastCheckTime
+	stateMutex.RUnlock()
+
+	return Snapshot{
+		Channels:      channels,
+		Users:         users,
+		LastSpeakers:  speakers,
+		LastCheckTime: cursor,
+	}
+}
+
+// restoreCaches はスナップショットのchannelMap/userMapをグローバルキャッシュへ反映する
+func restoreCaches(snap Snapshot) {
+	mapMutex.Lock()
+	channelMap = snap.Channels
+	userMap = snap.Users
+	mapMutex.Unlock()
+}
+
+// restoreSpeakers はスナップショットのlastSpeakersをグローバルキャッシュへ反映する。
+// channelMap/userMapの復元可否（fetchInitialDataが必要かどうか）とは独立の条件で
+// 呼ばれる想定なので、restoreCachesとは分けてある。
+func restoreSpeakers(snap Snapshot) {
+	stateMutex.Lock()
+	lastSpeakers = snap.LastSpeakers
+	stateMutex.Unlock()
+}
+
+// persistLoop は一定間隔でスナップショットを保存し続け、ctxがキャンセルされたら戻る。
+// 終了間際の最後のflushはshutdown側（runServer）が担当する。
+func persistLoop(ctx context.Context, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := store.Save(snapshotCaches()); err != nil {
+				log.Printf("⚠️ Failed to persist snapshot: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// --- 購読（サブスクリプション）フィルタ ---
+//
+// クライアントは {"type":"SUBSCRIBE","paths":[...]} で興味のあるパスを宣言できる。
+// パターンは完全一致、末尾"/*"（例: "/channels/random/*" は "/channels/random"
+// 自身とその配下すべてにマッチ）、末尾"*"による単純なprefix matchをサポートする。
+// "*"を含まないパターンは完全一致のみで、配下のパスにはマッチしない。
+// 何も購読していないクライアントは後方互換のため全パスを購読しているものとして扱う。
+
+// SubscribeMessage はクライアントからの購読要求
+type SubscribeMessage struct {
+	Type  string   `json:"type"`
+	Paths []string `json:"paths"`
+}
+
+// matchesSubscription は1つの購読パターンがpathにマッチするか判定する
+func matchesSubscription(pattern, path string) bool {
+	if pattern == path {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		prefix := strings.TrimSuffix(pattern, "/*")
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// matchesAny はpatternsのいずれかがpathにマッチすればtrue
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchesSubscription(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// wants はクライアントがpathを購読中かどうかを返す。購読パターンが1つも
+// 登録されていなければ（デフォルト状態）、全パスを購読しているとみなす。
+// JWTのchannelsクレームでallowedが設定されている場合は、それに含まれない
+// パスは（購読設定に関わらず）常に除外する。
+func (c *Client) wants(path string) bool {
+	c.subsMu.RLock()
+	defer c.subsMu.RUnlock()
+
+	if len(c.allowed) > 0 && !matchesAny(c.allowed, path) {
+		return false
+	}
+	if len(c.subs) == 0 {
+		return true
+	}
+	return matchesAny(c.subs, path)
+}
+
+func (c *Client) setSubscriptions(paths []string) {
+	c.subsMu.Lock()
+	c.subs = paths
+	c.subsMu.Unlock()
+}
+
+// snapshotFor はクライアントの購読に合致する分だけ抽出した、現在の発言者状態の
+// スナップショットを返す。busがRedisBusの場合はRedis hashの内容（全インスタンス
+// 共通の正本）を使うので、このインスタンスで初めて見るパスでも正しく返せる。
+func (c *Client) snapshotFor() map[string]string {
+	state, err := bus.State()
+	if err != nil {
+		log.Printf("⚠️ Failed to read bus state, falling back to local cache: %v", err)
+		stateMutex.RLock()
+		state = make(map[string]string, len(lastSpeakers))
+		for path, username := range lastSpeakers {
+			state[path] = username
+		}
+		stateMutex.RUnlock()
+	}
+
+	out := make(map[string]string)
+	for path, username := range state {
+		if c.wants(path) {
+			out[path] = username
+		}
+	}
+	return out
+}